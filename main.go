@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,44 +20,33 @@ import (
 )
 
 type Config struct {
-	Port              int
-	IP                string
-	IPwhitelist       bool
-	WhitelistedIPs    map[string]bool
-	CsvPath           string
-	LogPath           string
-	StaticCommand     string
-	ReturnResult      bool
-	RateLimit         int
-	ReplaceParam      bool
-	ReplaceRegex      *regexp.Regexp
-	DontStopReplacing bool
-	Args              []string //old input
-}
-
-func LoadRoutesIntoMap(newMap *sync.Map, csvText []byte, logger *slog.Logger) error {
-
-	r := csv.NewReader(bytes.NewReader(csvText))
-	rows, err := r.ReadAll()
-	if err != nil {
-		logger.Error("Error parsing csv!")
-		return err
-	}
-
-	for k, row := range rows {
-		path := row[0]
-		if path == "" {
-			logger.Warn("Skipping row because of missing URL", "row", k+1)
-			continue
-		}
-		cmd := row[1]
-		if cmd == "" {
-			logger.Warn("Skipping row because of missing command", "row", k+1)
-			continue
-		}
-		newMap.Store(path, cmd)
-	}
-	return nil
+	Port                  int
+	IP                    string
+	IPwhitelist           bool
+	WhitelistedIPs        map[string]bool
+	CsvPath               string
+	LogPath               string
+	StaticCommand         string
+	ReturnResult          bool
+	RateLimit             int
+	ReplaceParam          bool
+	ReplaceRegex          *regexp.Regexp
+	DontStopReplacing     bool
+	TLS                   bool
+	CertPath              string
+	KeyPath               string
+	ClientCAPath          string
+	IdentityWhitelist     bool
+	WhitelistedIdentities map[string]bool
+	TokensPath            string
+	Tokens                map[string]string
+	ReplaceHeaders        []string
+	RateLimitBackend      string
+	RedisURL              string
+	RateLimitKeyMode      string
+	ShutdownTimeout       time.Duration
+	PidFile               string
+	Args                  []string //old input
 }
 
 func ParseIPList(input string) map[string]bool {
@@ -88,6 +77,20 @@ func parseFlags(appname string, args []string) (config *Config, output string, e
 	flags.BoolVar(&conf.ReplaceParam, "replaceparam", false, "replace GET parameters starting with $ inside the bash script")
 	flags.StringVar(&regex, "replaceregex", "^[ a-zA-Z0-9/-]*$", "regex for allowed GET parameter replacing characters")
 	flags.BoolVar(&conf.DontStopReplacing, "nostop", false, "do not stop when encountering an error in the GET parameter replacement")
+	flags.BoolVar(&conf.TLS, "tls", false, "serve HTTPS instead of plain HTTP, requires -cert and -key")
+	flags.StringVar(&conf.CertPath, "cert", "", "path to the TLS certificate (PEM), only used with -tls")
+	flags.StringVar(&conf.KeyPath, "key", "", "path to the TLS private key (PEM), only used with -tls")
+	flags.StringVar(&conf.ClientCAPath, "clientca", "", "path to a CA bundle (PEM) to verify client certificates against, enables mTLS")
+	var allowedIdentities string
+	flags.StringVar(&allowedIdentities, "allowedidentities", "", "which client certificate CommonNames to accept in a comma-sep list, e.g. `client1,client2` (only relevant with -clientca, set to \"\" to disable)")
+	flags.StringVar(&conf.TokensPath, "tokens", "", "csv file mapping bearer tokens to auth identities, e.g. `./tokens.csv` (used to satisfy a route's auth column)")
+	var replaceHeaders string
+	flags.StringVar(&replaceHeaders, "replaceheaders", "", "which request headers to also expose to -replaceparam as $HEADER_NAME in a comma-sep list, e.g. `X-Api-Key,X-Request-Id`")
+	flags.StringVar(&conf.RateLimitBackend, "ratelimit-backend", "memory", "token-bucket rate limiter backend, `memory` or `redis`")
+	flags.StringVar(&conf.RedisURL, "redis-url", "", "redis address for -ratelimit-backend=redis, e.g. `127.0.0.1:6379`")
+	flags.StringVar(&conf.RateLimitKeyMode, "ratelimit-key", "route", "what the rate limiter keys buckets by: `route`, `ip`, or `route+ip`")
+	flags.DurationVar(&conf.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for in-flight commands on SIGINT/SIGTERM before force-killing them, e.g. `10s`")
+	flags.StringVar(&conf.PidFile, "pidfile", "", "write the process PID to this file on startup, removed again on clean shutdown, e.g. `./spuria.pid`")
 
 	err = flags.Parse(args)
 	if err != nil {
@@ -100,6 +103,20 @@ func parseFlags(appname string, args []string) (config *Config, output string, e
 		conf.WhitelistedIPs = ParseIPList(allowedIPs)
 	}
 
+	conf.WhitelistedIdentities = map[string]bool{}
+	if allowedIdentities != "" {
+		conf.IdentityWhitelist = true
+		conf.WhitelistedIdentities = ParseIPList(allowedIdentities)
+	}
+
+	if replaceHeaders != "" {
+		conf.ReplaceHeaders = strings.Split(replaceHeaders, ",")
+	}
+
+	if conf.TLS && (conf.CertPath == "" || conf.KeyPath == "") {
+		return nil, buf.String(), errors.New("-tls requires both -cert and -key")
+	}
+
 	// fmt.Println("regex:",regex)
 	conf.ReplaceRegex, err = regexp.Compile(regex)
 	if err != nil {
@@ -140,7 +157,7 @@ func main() {
 	//routes / bash commands
 	funcMap := sync.Map{}
 	if config.StaticCommand != "" {
-		funcMap.Store("/do", config.StaticCommand)
+		funcMap.Store("/do", NewRoute("/do", config.StaticCommand))
 	} else if config.CsvPath != "" {
 		fileBytes, err := os.ReadFile(config.CsvPath)
 		if err != nil {
@@ -155,152 +172,202 @@ func main() {
 		panic("ERROR: Please provide either -routes or -cmd !")
 	}
 
+	//bearer tokens
+	config.Tokens = map[string]string{}
+	if config.TokensPath != "" {
+		fileBytes, err := os.ReadFile(config.TokensPath)
+		if err != nil {
+			logger.Error("Couldn't read tokens file!")
+			panic(err)
+		}
+		config.Tokens, err = LoadTokensIntoMap(fileBytes, logger)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	server, err := NewServer(config, &funcMap, logger)
+	if err != nil {
+		logger.Error("couldn't build server (rate limiter or routes)", "err", err)
+		panic(err)
+	}
+	if config.CsvPath != "" {
+		go WatchRoutes(server, config.CsvPath, logger)
+	}
+
+	if config.PidFile != "" {
+		if err := os.WriteFile(config.PidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			logger.Error("couldn't write pidfile", "path", config.PidFile, "err", err)
+			panic(err)
+		}
+	}
+
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(config.IP, strconv.Itoa(config.Port)),
-		Handler: NewServer(config, &funcMap, logger),
+		Handler: server,
 	}
 
+	shutdownDone := make(chan struct{})
+	go func() {
+		WaitForShutdownSignal(httpServer, server.tracker, config, logger)
+		close(shutdownDone)
+	}()
+
 	donetime := time.Now()
-	logger.Info("Startup finished", "timetaken", donetime.Sub(starttime).String(), "ip", config.IP, "port", config.Port, "configLocation", config.CsvPath, "allowedIPs", config.WhitelistedIPs, "logLocation", config.LogPath)
+	logger.Info("Startup finished", "timetaken", donetime.Sub(starttime).String(), "ip", config.IP, "port", config.Port, "configLocation", config.CsvPath, "allowedIPs", config.WhitelistedIPs, "logLocation", config.LogPath, "tls", config.TLS, "pidfile", config.PidFile)
 	fmt.Println("Listening on ", config.IP, ":", config.Port)
 
-	fmt.Println(httpServer.ListenAndServe())
+	var serveErr error
+	if config.TLS {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			logger.Error("couldn't build TLS config", "err", err)
+			panic(err)
+		}
+		httpServer.TLSConfig = tlsConfig
+		serveErr = httpServer.ListenAndServeTLS(config.CertPath, config.KeyPath)
+	} else {
+		serveErr = httpServer.ListenAndServe()
+	}
+	if !errors.Is(serveErr, http.ErrServerClosed) {
+		fmt.Println(serveErr)
+		if config.PidFile != "" {
+			if err := os.Remove(config.PidFile); err != nil {
+				logger.Warn("couldn't remove pidfile", "path", config.PidFile, "err", err)
+			}
+		}
+		os.Exit(1)
+	}
+
+	<-shutdownDone
 }
 
-func NewServer(config *Config, funcMap *sync.Map, logger *slog.Logger) http.Handler {
-	mux := http.NewServeMux()
-	//ratelimit
-	mu := sync.Mutex{}
-	// _=mu
-	reqCounter := map[string]int{}
-	// _=reqCounter
-	resetTime := atomic.Int64{}
-	resetTime.Store(time.Now().Add(60 * time.Second).Unix())
-
-	//web
-	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "# TYPE isupdummy counter")
-		fmt.Fprintln(w, "isupdummy 1")
-	})
-	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			LogRequest(logger, r, 200, nil)
-			return
-		}
+// Server holds everything that must survive a routes.csv reload: the active
+// mux is rebuilt and swapped on each reload, while the rate limiter,
+// in-flight command tracker and metrics keep accumulating across reloads.
+type Server struct {
+	config  *Config
+	logger  *slog.Logger
+	metrics *Metrics
+	limiter RateLimiter
+	tracker *CommandTracker
 
-		defer func() {
-			if rc := recover(); rc != nil {
-				err := rc.(error)
-				LogRequest(logger, r, 500, err)
-			}
-		}()
+	routes atomic.Pointer[sync.Map]
+	mux    atomic.Pointer[http.ServeMux]
 
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			fmt.Println("ERROR WHEN PARSING REMOTEADDR")
-			fmt.Println(err)
-			return
-		}
+	reloadMu sync.Mutex // serializes Reload, since it's a read-modify-write of routes
+}
 
-		//ip whitelist
-		if exists, value := config.WhitelistedIPs[ip]; config.IPwhitelist && (!exists || !value) {
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprint(w, "NOACCESS")
-			LogRequest(logger, r, 403, nil)
-			return
-		}
+func NewServer(config *Config, funcMap *sync.Map, logger *slog.Logger) (*Server, error) {
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:  config,
+		logger:  logger,
+		metrics: NewMetrics(),
+		limiter: limiter,
+		tracker: NewCommandTracker(),
+	}
+	s.routes.Store(funcMap)
+	if err := s.rebuildMux(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-		//ratelimiter
-		mu.Lock()
-		reqCounter[r.URL.Path]++
-		timeWhenReset := resetTime.Load()
-		if time.Now().Unix() > timeWhenReset {
-			reqCounter[r.URL.Path] = 1
-			resetTime.Store(time.Now().Add(60 * time.Second).Unix())
-		}
-		if reqCounter[r.URL.Path] > config.RateLimit && config.RateLimit != 0 {
-			mu.Unlock()
-			w.WriteHeader(http.StatusTooManyRequests)
-			LogRequest(logger, r, 429, nil)
-			return
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Load().ServeHTTP(w, r)
+}
+
+// rebuildMux constructs a fresh *http.ServeMux from the currently loaded
+// routes and atomically swaps it in, so in-flight requests keep using
+// whichever mux they started with. s.mux is only touched on success, so a
+// failed rebuild (e.g. a method-less "/" row colliding with the catch-all
+// handler, or a path that isn't a valid mux pattern) just
+// leaves whatever mux was already serving in place; it never panics the
+// process, which matters since this also runs on every routes.csv reload.
+func (s *Server) rebuildMux() (err error) {
+	defer func() {
+		if rc := recover(); rc != nil {
+			err = fmt.Errorf("panic while building routes: %v", rc)
 		}
-		mu.Unlock()
+	}()
 
-		if value, exists := funcMap.Load(r.URL.Path); exists {
-			err, stdout, stderr := ExecuteCommand(r, value.(string), config, logger)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				if config.ReturnResult {
-					fmt.Fprint(w, stderr)
-				} else {
-					fmt.Fprint(w, "ERR")
-				}
-				LogRequest(logger, r, 500, nil)
-			} else {
-				w.WriteHeader(http.StatusOK)
-				if config.ReturnResult {
-					fmt.Fprint(w, stdout)
-				} else {
-					fmt.Fprint(w, "OK")
-				}
-				LogRequest(logger, r, 200, nil)
-			}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.metrics.WritePrometheusText(w)
+	})
+	mux.HandleFunc("POST /-/reload", s.handleReload)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			s.metrics.ObserveRequest(r.URL.Path, 200)
+			LogRequest(s.logger, r, 200, nil)
 			return
 		}
+		s.metrics.ObserveRequest(r.URL.Path, 404)
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "URL not found or configured! (%q)", r.URL.Path)
-		LogRequest(logger, r, 404, nil)
+		LogRequest(s.logger, r, 404, nil)
+	})
+
+	s.routes.Load().Range(func(key, value any) bool {
+		route := value.(*Route)
+		pattern := route.Path
+		if route.Method != "*" {
+			pattern = route.Method + " " + route.Path
+		}
+		mux.HandleFunc(pattern, RouteHandler(route, s.config, s.logger, s.metrics, s.limiter, s.tracker))
+		return true
 	})
-	return mux
+
+	s.mux.Store(mux)
+	return nil
 }
 
 func LogRequest(logger *slog.Logger, r *http.Request, returnCode int, err error) {
-	logger.Info("request", "method", r.Method, "url", r.URL.Path, "status", returnCode, "source", r.RemoteAddr, "proto", r.Proto, "host", r.Host, "referer", r.Referer(), "useragent", r.UserAgent(), "err", err)
+	logger.Info("request", "method", r.Method, "url", r.URL.Path, "status", returnCode, "source", r.RemoteAddr, "proto", r.Proto, "host", r.Host, "referer", r.Referer(), "useragent", r.UserAgent(), "identity", ClientIdentity(r), "err", err)
 }
 
-func ExecuteCommand(r *http.Request, command string, config *Config, logger *slog.Logger) (error, string, string) {
+func ExecuteCommand(r *http.Request, command string, config *Config, logger *slog.Logger, metrics *Metrics, tracker *CommandTracker, timeout time.Duration) (error, string, string) {
 	path := r.URL.Path
-	params := r.URL.Query()
-	if len(params) > 0 && config.ReplaceParam {
-		logger.Info("replacing params", "params", params)
-		for name, values := range params {
-			value := values[0]
-			if len(values) <= 0 || len(values) > 1 {
-				logger.Warn("get param error, please only set GET parameter value once for each key", "path", path, "name", name, "length", len(values))
-				if config.DontStopReplacing {
-					continue
-				} else {
-					return errors.New("GET param has more than 1 or less than 1 values"), "", ""
-				}
-			}
-
-			if !strings.HasPrefix(name, "$") {
-				logger.Warn("get param error, name has to begin with $", "path", path, "name", name, "value", value)
-				if config.DontStopReplacing {
-					continue
-				} else {
-					return errors.New("GET param name doesn't begin with $"), "", ""
-				}
-			}
-			if !config.ReplaceRegex.MatchString(value) {
-				logger.Warn("get param error, invalid input for regex", "path", path, "name", name, "value", value)
-				if config.DontStopReplacing {
-					continue
-				} else {
-					return errors.New("GET param value doesn't match regex"), "", ""
-				}
+	if config.ReplaceParam {
+		params := CollectParams(r, config, logger)
+		if len(params) > 0 {
+			var err error
+			command, err = ApplySubstitutions(command, params, config, logger, path)
+			if err != nil {
+				return err, "", ""
 			}
-			command = strings.ReplaceAll(command, name, value)
 		}
 	}
-	ec := exec.Command("bash", "-c", command) //.Output()
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ec := exec.CommandContext(ctx, "bash", "-c", command)
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	ec.Stdout = &stdout
 	ec.Stderr = &stderr
+	metrics.IncRunningCommands()
 	starttime := time.Now()
-	err := ec.Run()
-	timeTaken := time.Since(starttime).String()
+	if err := ec.Start(); err != nil {
+		metrics.DecRunningCommands()
+		logger.Error("couldn't start command", "path", path, "err", err)
+		return err, "", ""
+	}
+	untrack := tracker.Track(ec)
+	err := ec.Wait()
+	untrack()
+	elapsed := time.Since(starttime)
+	metrics.DecRunningCommands()
+	metrics.ObserveDuration(path, elapsed.Seconds())
+	timeTaken := elapsed.String()
 	outStr := stdout.String()
 	errStr := stderr.String()
 	if err != nil {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// durationBuckets are the histogram bucket upper bounds (in seconds) used for
+// spuria_command_duration_seconds, matching the Prometheus client defaults.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds the in-process counters/gauges/histograms exposed on
+// GET /metrics. All route-keyed fields are guarded by mu; the plain gauges
+// below use atomics since they're not keyed by route.
+type Metrics struct {
+	mu               sync.Mutex
+	requestsByStatus map[string]map[string]int64 // route -> status -> count
+	durationSum      map[string]float64          // route -> sum of seconds
+	durationCount    map[string]int64            // route -> observation count
+	durationBuckets  map[string][]int64          // route -> cumulative count per bucket in durationBuckets
+
+	runningCommands       atomic.Int64
+	rateLimitRejections   atomic.Int64
+	ipWhitelistRejections atomic.Int64
+	authRejections        atomic.Int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requestsByStatus: map[string]map[string]int64{},
+		durationSum:      map[string]float64{},
+		durationCount:    map[string]int64{},
+		durationBuckets:  map[string][]int64{},
+	}
+}
+
+// ObserveRequest records that route finished with the given HTTP status.
+func (m *Metrics) ObserveRequest(route string, status int) {
+	statusStr := strconv.Itoa(status)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requestsByStatus[route] == nil {
+		m.requestsByStatus[route] = map[string]int64{}
+	}
+	m.requestsByStatus[route][statusStr]++
+}
+
+// ObserveDuration records how long a command on route took to run.
+func (m *Metrics) ObserveDuration(route string, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durationSum[route] += seconds
+	m.durationCount[route]++
+
+	buckets := m.durationBuckets[route]
+	if buckets == nil {
+		buckets = make([]int64, len(durationBuckets))
+		m.durationBuckets[route] = buckets
+	}
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			buckets[i]++
+		}
+	}
+}
+
+func (m *Metrics) IncRunningCommands()      { m.runningCommands.Add(1) }
+func (m *Metrics) DecRunningCommands()      { m.runningCommands.Add(-1) }
+func (m *Metrics) IncRateLimitRejection()   { m.rateLimitRejections.Add(1) }
+func (m *Metrics) IncIPWhitelistRejection() { m.ipWhitelistRejections.Add(1) }
+func (m *Metrics) IncAuthRejection()        { m.authRejections.Add(1) }
+
+// WritePrometheusText renders the current metrics in the Prometheus text exposition
+// format.
+func (m *Metrics) WritePrometheusText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP spuria_requests_total Total number of requests handled, by route and status.")
+	fmt.Fprintln(w, "# TYPE spuria_requests_total counter")
+	for _, route := range sortedKeys(m.requestsByStatus) {
+		statuses := m.requestsByStatus[route]
+		for _, status := range sortedKeys(statuses) {
+			fmt.Fprintf(w, "spuria_requests_total{route=%q,status=%q} %d\n", route, status, statuses[status])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP spuria_command_duration_seconds Duration of command execution in seconds.")
+	fmt.Fprintln(w, "# TYPE spuria_command_duration_seconds histogram")
+	for _, route := range sortedKeys(m.durationCount) {
+		buckets := m.durationBuckets[route]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "spuria_command_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(le, 'g', -1, 64), buckets[i])
+		}
+		fmt.Fprintf(w, "spuria_command_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, m.durationCount[route])
+		fmt.Fprintf(w, "spuria_command_duration_seconds_sum{route=%q} %s\n", route, strconv.FormatFloat(m.durationSum[route], 'g', -1, 64))
+		fmt.Fprintf(w, "spuria_command_duration_seconds_count{route=%q} %d\n", route, m.durationCount[route])
+	}
+
+	fmt.Fprintln(w, "# HELP spuria_commands_running Number of commands currently executing.")
+	fmt.Fprintln(w, "# TYPE spuria_commands_running gauge")
+	fmt.Fprintf(w, "spuria_commands_running %d\n", m.runningCommands.Load())
+
+	fmt.Fprintln(w, "# HELP spuria_ratelimit_rejections_total Total number of requests rejected by the rate limiter.")
+	fmt.Fprintln(w, "# TYPE spuria_ratelimit_rejections_total counter")
+	fmt.Fprintf(w, "spuria_ratelimit_rejections_total %d\n", m.rateLimitRejections.Load())
+
+	fmt.Fprintln(w, "# HELP spuria_ip_whitelist_rejections_total Total number of requests rejected by the IP/identity whitelist.")
+	fmt.Fprintln(w, "# TYPE spuria_ip_whitelist_rejections_total counter")
+	fmt.Fprintf(w, "spuria_ip_whitelist_rejections_total %d\n", m.ipWhitelistRejections.Load())
+
+	fmt.Fprintln(w, "# HELP spuria_auth_rejections_total Total number of requests rejected by a route's auth tag.")
+	fmt.Fprintln(w, "# TYPE spuria_auth_rejections_total counter")
+	fmt.Fprintf(w, "spuria_auth_rejections_total %d\n", m.authRejections.Load())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
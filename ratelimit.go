@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter implements a token-bucket limiter: each key holds a bucket of
+// up to capacity tokens, refilled at refillPerSec tokens/second. Allow
+// reports whether a token was available (and consumed) for key, and if not,
+// how long the caller should wait before retrying.
+type RateLimiter interface {
+	Allow(key string, capacity int, refillPerSec float64) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// NewRateLimiter builds the RateLimiter selected by -ratelimit-backend.
+func NewRateLimiter(config *Config) (RateLimiter, error) {
+	switch config.RateLimitBackend {
+	case "", "memory":
+		return NewMemoryRateLimiter(), nil
+	case "redis":
+		return NewRedisRateLimiter(config.RedisURL)
+	default:
+		return nil, fmt.Errorf("unknown -ratelimit-backend %q, want memory or redis", config.RateLimitBackend)
+	}
+}
+
+// RateLimitKey builds the bucket key for a request, per -ratelimit-key.
+func RateLimitKey(mode string, path string, ip string) string {
+	switch mode {
+	case "ip":
+		return ip
+	case "route+ip":
+		return path + "|" + ip
+	default: // "route"
+		return path
+	}
+}
+
+// memoryBucket is one token bucket, guarded by MemoryRateLimiter.mu.
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimiter is the default, single-process RateLimiter.
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*memoryBucket{}}
+}
+
+func (rl *MemoryRateLimiter) Allow(key string, capacity int, refillPerSec float64) (bool, time.Duration, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &memoryBucket{tokens: float64(capacity), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(capacity), b.tokens+now.Sub(b.last).Seconds()*refillPerSec)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	retryAfter := time.Duration(math.Ceil((1 - b.tokens) / refillPerSec * float64(time.Second)))
+	return false, retryAfter, nil
+}
+
+// tokenBucketScript refills and consumes a token atomically so concurrent
+// requests across processes can't race past the same bucket. KEYS[1] is the
+// bucket key; ARGV is capacity, refillPerSec, now (all as strings Redis
+// parses with tonumber).
+const tokenBucketScript = `
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local refillPerSec = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local data = redis.call('HMGET', key, 'tokens', 'last')
+local tokens = tonumber(data[1])
+local last = tonumber(data[2])
+if tokens == nil then
+  tokens = capacity
+  last = now
+end
+
+local elapsed = now - last
+if elapsed < 0 then elapsed = 0 end
+tokens = math.min(capacity, tokens + elapsed * refillPerSec)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry_after = (1 - tokens) / refillPerSec
+end
+
+redis.call('HMSET', key, 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', key, 3600)
+
+return {allowed, tostring(retry_after)}
+`
+
+// RedisRateLimiter runs the token-bucket algorithm via EVAL so the
+// refill-and-decrement stays atomic across every spuria process sharing the
+// same Redis instance. It speaks just enough RESP to issue EVAL and read its
+// reply - no client library is pulled in for this one command.
+type RedisRateLimiter struct {
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisRateLimiter(redisURL string) (*RedisRateLimiter, error) {
+	if redisURL == "" {
+		return nil, errors.New("-ratelimit-backend=redis requires -redis-url")
+	}
+	addr := redisURL
+	if u, err := url.Parse(redisURL); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	return &RedisRateLimiter{addr: addr}, nil
+}
+
+func (rl *RedisRateLimiter) Allow(key string, capacity int, refillPerSec float64) (bool, time.Duration, error) {
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	reply, err := rl.eval(tokenBucketScript, []string{key}, []string{
+		strconv.Itoa(capacity),
+		strconv.FormatFloat(refillPerSec, 'f', -1, 64),
+		strconv.FormatFloat(now, 'f', -1, 64),
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	arr, ok := reply.([]any)
+	if !ok || len(arr) != 2 {
+		return false, 0, fmt.Errorf("unexpected EVAL reply: %#v", reply)
+	}
+	allowedNum, _ := arr[0].(int64)
+	retryStr, _ := arr[1].(string)
+	retrySeconds, _ := strconv.ParseFloat(retryStr, 64)
+
+	if allowedNum == 1 {
+		return true, 0, nil
+	}
+	return false, time.Duration(math.Ceil(retrySeconds)) * time.Second, nil
+}
+
+func (rl *RedisRateLimiter) eval(script string, keys []string, args []string) (any, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.conn == nil {
+		conn, err := net.DialTimeout("tcp", rl.addr, 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		rl.conn = conn
+		rl.reader = bufio.NewReader(conn)
+	}
+
+	command := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	command = append(command, args...)
+
+	if err := writeRESPCommand(rl.conn, command); err != nil {
+		rl.conn.Close()
+		rl.conn, rl.reader = nil, nil
+		return nil, err
+	}
+
+	reply, err := readRESPValue(rl.reader)
+	if err != nil {
+		rl.conn.Close()
+		rl.conn, rl.reader = nil, nil
+		return nil, err
+	}
+	return reply, nil
+}
+
+func writeRESPCommand(w io.Writer, args []string) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// readRESPValue parses one RESP value: a simple string/integer/bulk string,
+// an error (returned as a Go error), or an array of these (as []any).
+func readRESPValue(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty RESP reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2) // +2 for the trailing \r\n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			v, err := readRESPValue(r)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unrecognized RESP type %q", line[0])
+	}
+}
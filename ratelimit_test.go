@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	cases := []struct {
+		mode string
+		want string
+	}{
+		{"route", "/do"},
+		{"ip", "1.2.3.4"},
+		{"route+ip", "/do|1.2.3.4"},
+		{"", "/do"}, // unknown/empty mode falls back to "route"
+	}
+	for _, c := range cases {
+		if got := RateLimitKey(c.mode, "/do", "1.2.3.4"); got != c.want {
+			t.Errorf("RateLimitKey(%q, ...) = %q, want %q", c.mode, got, c.want)
+		}
+	}
+}
+
+func TestMemoryRateLimiterTokenBucket(t *testing.T) {
+	rl := NewMemoryRateLimiter()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := rl.Allow("k", 3, 1)
+		if err != nil {
+			t.Fatalf("Allow() returned error: %v", err)
+		}
+		if !allowed {
+			t.Fatalf("request %d: expected allowed, bucket should still have tokens", i+1)
+		}
+	}
+
+	allowed, retryAfter, err := rl.Allow("k", 3, 1)
+	if err != nil {
+		t.Fatalf("Allow() returned error: %v", err)
+	}
+	if allowed {
+		t.Fatal("expected the 4th request to be rejected, bucket should be empty")
+	}
+	if retryAfter <= 0 || retryAfter > 2*time.Second {
+		t.Errorf("retryAfter = %v, want a small positive duration close to 1s", retryAfter)
+	}
+
+	allowed, _, err = rl.Allow("other-key", 3, 1)
+	if err != nil {
+		t.Fatalf("Allow() returned error: %v", err)
+	}
+	if !allowed {
+		t.Error("a different key should have its own, untouched bucket")
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	if _, err := NewRateLimiter(&Config{RateLimitBackend: "bogus"}); err == nil {
+		t.Error("expected an error for an unknown -ratelimit-backend")
+	}
+	if _, err := NewRateLimiter(&Config{RateLimitBackend: "redis"}); err == nil {
+		t.Error("expected -ratelimit-backend=redis without -redis-url to fail")
+	}
+	if limiter, err := NewRateLimiter(&Config{}); err != nil {
+		t.Errorf("default backend should be memory, got error: %v", err)
+	} else if _, ok := limiter.(*MemoryRateLimiter); !ok {
+		t.Errorf("default backend should be *MemoryRateLimiter, got %T", limiter)
+	}
+}
+
+func TestReadRESPValue(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  any
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"integer", ":42\r\n", int64(42)},
+		{"bulk string", "$5\r\nhello\r\n", "hello"},
+		{"null bulk string", "$-1\r\n", nil},
+		{"array", "*2\r\n:1\r\n:0\r\n", []any{int64(1), int64(0)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := readRESPValue(bufio.NewReader(strings.NewReader(c.input)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if arr, ok := c.want.([]any); ok {
+				gotArr, ok := got.([]any)
+				if !ok || len(gotArr) != len(arr) {
+					t.Fatalf("got %#v, want %#v", got, c.want)
+				}
+				for i := range arr {
+					if gotArr[i] != arr[i] {
+						t.Errorf("element %d: got %#v, want %#v", i, gotArr[i], arr[i])
+					}
+				}
+				return
+			}
+			if got != c.want {
+				t.Errorf("got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadRESPValueError(t *testing.T) {
+	_, err := readRESPValue(bufio.NewReader(strings.NewReader("-ERR something broke\r\n")))
+	if err == nil || !strings.Contains(err.Error(), "something broke") {
+		t.Errorf("expected an error carrying the RESP error message, got %v", err)
+	}
+}
+
+func TestWriteRESPCommand(t *testing.T) {
+	var buf strings.Builder
+	if err := writeRESPCommand(&buf, []string{"EVAL", "return 1", "1", "mykey"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "*4\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n1\r\n$5\r\nmykey\r\n"
+	if buf.String() != want {
+		t.Errorf("writeRESPCommand() = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reload re-reads config.CsvPath and, if it parses cleanly and rebuilds into
+// a working mux, swaps it in as the active route set. On a read/parse error,
+// or a route that can't be registered (e.g. a method-less "/" row colliding
+// with the catch-all handler),
+// the previously loaded routes are kept untouched and the error is returned -
+// this must never panic, since it can run long after startup.
+//
+// Reload can be called concurrently from WatchRoutes and the POST /-/reload
+// handler; reloadMu serializes the whole read-modify-write of s.routes so a
+// slower reload's failure-path revert can't stomp a faster, concurrently
+// successful one.
+func (s *Server) Reload() (int, error) {
+	if s.config.CsvPath == "" {
+		return 0, errors.New("no -routes csv configured, nothing to reload")
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	fileBytes, err := os.ReadFile(s.config.CsvPath)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read %s: %w", s.config.CsvPath, err)
+	}
+
+	newRoutes := &sync.Map{}
+	if err := LoadRoutesIntoMap(newRoutes, fileBytes, s.logger); err != nil {
+		return 0, fmt.Errorf("couldn't parse %s: %w", s.config.CsvPath, err)
+	}
+
+	oldRoutes := s.routes.Load()
+	s.routes.Store(newRoutes)
+	if err := s.rebuildMux(); err != nil {
+		s.routes.Store(oldRoutes)
+		return 0, fmt.Errorf("couldn't build routes from %s, keeping previous set: %w", s.config.CsvPath, err)
+	}
+
+	count := 0
+	newRoutes.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+// handleReload is the POST /-/reload admin endpoint, restricted to whitelisted
+// IPs/identities the same way regular routes are.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !IsAuthorized(s.config, ip, ClientIdentity(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "NOACCESS")
+		LogRequest(s.logger, r, 403, nil)
+		return
+	}
+
+	count, err := s.Reload()
+	if err != nil {
+		s.logger.Error("reload via /-/reload failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "reload failed: %v", err)
+		LogRequest(s.logger, r, 500, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "reloaded %d routes", count)
+	LogRequest(s.logger, r, 200, nil)
+}
+
+// WatchRoutes reloads csvPath whenever it receives SIGHUP or notices the
+// file's mtime has changed, for as long as the process runs. It never
+// panics - a bad edit to routes.csv just gets logged and ignored until the
+// file is fixed.
+func WatchRoutes(server *Server, csvPath string, logger *slog.Logger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	var lastMod time.Time
+	if info, err := os.Stat(csvPath); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigCh:
+			logger.Info("reloading routes, triggered by SIGHUP")
+			if count, err := server.Reload(); err != nil {
+				logger.Error("reload failed", "err", err)
+			} else {
+				logger.Info("reload finished", "routes", count)
+			}
+		case <-ticker.C:
+			info, err := os.Stat(csvPath)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			logger.Info("reloading routes, triggered by file change", "path", csvPath)
+			if count, err := server.Reload(); err != nil {
+				logger.Error("reload failed", "err", err)
+			} else {
+				logger.Info("reload finished", "routes", count)
+			}
+		}
+	}
+}
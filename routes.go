@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route describes everything spuria knows about one configured endpoint.
+// Most of this comes from the optional trailing columns in routes.csv; any
+// column that's missing or empty falls back to a sane default so the
+// original 2-column (path,command) CSV format keeps working unchanged.
+type Route struct {
+	Path        string
+	Command     string
+	Stream      bool          // command output is streamed via SSE instead of buffered
+	Method      string        // "*" means any method
+	Timeout     time.Duration // 0 means no timeout
+	RateLimit   int           // -1 means "use config.RateLimit"
+	Auth        string        // required mTLS identity / bearer token tag, "" means none
+	ContentType string        // response Content-Type when -returnresult is set, "" means default
+}
+
+// ReservedPaths are spuria's own admin endpoints, registered on every mux
+// before any routes.csv row. A CSV row reusing one of these would otherwise
+// either panic the mux registration at startup or reload time (same method
+// as the admin handler) or answer that path for every other method.
+var ReservedPaths = map[string]bool{
+	"/metrics":  true,
+	"/-/reload": true,
+}
+
+// NewRoute builds a Route from a path and raw (possibly "stream:"-prefixed)
+// command, applying the same defaults LoadRoutesIntoMap uses for the
+// optional CSV columns.
+func NewRoute(path string, rawCommand string) *Route {
+	command, stream := strings.CutPrefix(rawCommand, StreamCommandPrefix)
+	return &Route{
+		Path:      path,
+		Command:   command,
+		Stream:    stream,
+		Method:    "*",
+		RateLimit: -1,
+	}
+}
+
+// LoadRoutesIntoMap parses routes.csv and stores a *Route per row in newMap,
+// keyed by path. Beyond the original (path,command) columns it accepts five
+// more, in order: method, timeout, ratelimit, auth, contenttype. All of them
+// are optional and rows may omit any number of trailing columns.
+func LoadRoutesIntoMap(newMap *sync.Map, csvText []byte, logger *slog.Logger) error {
+
+	r := csv.NewReader(bytes.NewReader(csvText))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		logger.Error("Error parsing csv!")
+		return err
+	}
+
+	for k, row := range rows {
+		path := col(row, 0)
+		if path == "" {
+			logger.Warn("Skipping row because of missing URL", "row", k+1)
+			continue
+		}
+		if ReservedPaths[path] {
+			logger.Warn("Skipping row because the path is reserved for spuria's own admin endpoints", "row", k+1, "path", path)
+			continue
+		}
+		cmd := col(row, 1)
+		if cmd == "" {
+			logger.Warn("Skipping row because of missing command", "row", k+1)
+			continue
+		}
+
+		route := NewRoute(path, cmd)
+
+		if col(row, 2) != "" {
+			route.Method = strings.ToUpper(strings.TrimSpace(col(row, 2)))
+		}
+		if col(row, 3) != "" {
+			timeout, err := time.ParseDuration(col(row, 3))
+			if err != nil {
+				logger.Warn("Skipping timeout column, couldn't parse duration", "row", k+1, "timeout", col(row, 3), "err", err)
+			} else {
+				route.Timeout = timeout
+			}
+		}
+		if col(row, 4) != "" {
+			rateLimit, err := strconv.Atoi(col(row, 4))
+			if err != nil {
+				logger.Warn("Skipping ratelimit column, couldn't parse integer", "row", k+1, "ratelimit", col(row, 4), "err", err)
+			} else {
+				route.RateLimit = rateLimit
+			}
+		}
+		route.Auth = strings.TrimSpace(col(row, 5))
+		route.ContentType = strings.TrimSpace(col(row, 6))
+
+		newMap.Store(path, route)
+	}
+	return nil
+}
+
+// col returns row[i], or "" if the row doesn't have that many columns.
+func col(row []string, i int) string {
+	if i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
+
+// LoadTokensIntoMap parses a (token,identity) CSV used by -tokens, mapping a
+// bearer token to the auth identity it should be treated as - the same
+// identity tag a Route.Auth or mTLS CommonName would carry.
+func LoadTokensIntoMap(csvText []byte, logger *slog.Logger) (map[string]string, error) {
+	tokens := map[string]string{}
+
+	r := csv.NewReader(bytes.NewReader(csvText))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		logger.Error("Error parsing tokens csv!")
+		return nil, err
+	}
+
+	for k, row := range rows {
+		token := col(row, 0)
+		if token == "" {
+			logger.Warn("Skipping tokens row because of missing token", "row", k+1)
+			continue
+		}
+		identity := col(row, 1)
+		if identity == "" {
+			logger.Warn("Skipping tokens row because of missing identity", "row", k+1)
+			continue
+		}
+		tokens[token] = identity
+	}
+	return tokens, nil
+}
+
+// BearerIdentity returns the auth identity associated with the bearer token
+// on this request, or "" if there is none or it isn't recognized.
+func BearerIdentity(r *http.Request, tokens map[string]string) string {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return tokens[token]
+}
+
+// RouteAuthorized checks a route's optional auth tag against the mTLS
+// client identity and/or bearer token identity presented with the request.
+// A route with no Auth tag is open to anyone who already passed the
+// IP/identity whitelist.
+func RouteAuthorized(route *Route, clientIdentity string, bearerIdentity string) bool {
+	if route.Auth == "" {
+		return true
+	}
+	return route.Auth == clientIdentity || route.Auth == bearerIdentity
+}
+
+// RouteHandler builds the http.HandlerFunc for one configured route: IP/
+// identity whitelist, per-route auth tag, per-route (or global) rate limit,
+// then dispatch to ExecuteCommand or StreamCommand depending on route.Stream.
+// limiter is shared across all routes and reloads, per -ratelimit-backend.
+// tracker keeps every spawned bash process tracked for graceful shutdown.
+func RouteHandler(route *Route, config *Config, logger *slog.Logger, metrics *Metrics, limiter RateLimiter, tracker *CommandTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rc := recover(); rc != nil {
+				err := rc.(error)
+				LogRequest(logger, r, 500, err)
+			}
+		}()
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			fmt.Println("ERROR WHEN PARSING REMOTEADDR")
+			fmt.Println(err)
+			return
+		}
+
+		//ip / mTLS identity whitelist
+		clientIdentity := ClientIdentity(r)
+		if !IsAuthorized(config, ip, clientIdentity) {
+			metrics.IncIPWhitelistRejection()
+			metrics.ObserveRequest(r.URL.Path, 403)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "NOACCESS")
+			LogRequest(logger, r, 403, nil)
+			return
+		}
+
+		//per-route auth tag (mTLS identity or -tokens bearer token)
+		bearerIdentity := BearerIdentity(r, config.Tokens)
+		if !RouteAuthorized(route, clientIdentity, bearerIdentity) {
+			metrics.IncAuthRejection()
+			metrics.ObserveRequest(r.URL.Path, 403)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "NOACCESS")
+			LogRequest(logger, r, 403, nil)
+			return
+		}
+
+		//ratelimiter, route.RateLimit overrides config.RateLimit when set
+		limit := route.RateLimit
+		if limit < 0 {
+			limit = config.RateLimit
+		}
+		if limit != 0 {
+			key := RateLimitKey(config.RateLimitKeyMode, r.URL.Path, ip)
+			allowed, retryAfter, err := limiter.Allow(key, limit, float64(limit)/60)
+			if err != nil {
+				logger.Error("rate limiter error", "path", r.URL.Path, "err", err)
+				metrics.ObserveRequest(r.URL.Path, 500)
+				w.WriteHeader(http.StatusInternalServerError)
+				LogRequest(logger, r, 500, err)
+				return
+			}
+			if !allowed {
+				metrics.IncRateLimitRejection()
+				metrics.ObserveRequest(r.URL.Path, 429)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				LogRequest(logger, r, 429, nil)
+				return
+			}
+		}
+
+		if route.ContentType != "" && config.ReturnResult {
+			w.Header().Set("Content-Type", route.ContentType)
+		}
+
+		if route.Stream {
+			metrics.ObserveRequest(r.URL.Path, 200)
+			StreamCommand(w, r, route.Command, config, logger, metrics, tracker, route.Timeout)
+			return
+		}
+
+		err, stdout, stderr := ExecuteCommand(r, route.Command, config, logger, metrics, tracker, route.Timeout)
+		if errors.Is(err, ErrInvalidParam) {
+			metrics.ObserveRequest(r.URL.Path, 400)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			LogRequest(logger, r, 400, err)
+		} else if err != nil {
+			metrics.ObserveRequest(r.URL.Path, 500)
+			w.WriteHeader(http.StatusInternalServerError)
+			if config.ReturnResult {
+				fmt.Fprint(w, stderr)
+			} else {
+				fmt.Fprint(w, "ERR")
+			}
+			LogRequest(logger, r, 500, nil)
+		} else {
+			metrics.ObserveRequest(r.URL.Path, 200)
+			w.WriteHeader(http.StatusOK)
+			if config.ReturnResult {
+				fmt.Fprint(w, stdout)
+			} else {
+				fmt.Fprint(w, "OK")
+			}
+			LogRequest(logger, r, 200, nil)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loadRoutes(t *testing.T, csvText string) *sync.Map {
+	t.Helper()
+	m := &sync.Map{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := LoadRoutesIntoMap(m, []byte(csvText), logger); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m
+}
+
+func mustRoute(t *testing.T, m *sync.Map, path string) *Route {
+	t.Helper()
+	v, ok := m.Load(path)
+	if !ok {
+		t.Fatalf("expected a route for %q", path)
+	}
+	return v.(*Route)
+}
+
+func TestLoadRoutesIntoMapDefaults(t *testing.T) {
+	m := loadRoutes(t, "/do,echo hi\n")
+	route := mustRoute(t, m, "/do")
+	if route.Method != "*" || route.RateLimit != -1 || route.Timeout != 0 {
+		t.Errorf("got %+v, want method=*, ratelimit=-1, timeout=0", route)
+	}
+}
+
+func TestLoadRoutesIntoMapOptionalColumns(t *testing.T) {
+	m := loadRoutes(t, "/do,echo hi,get,5s,42,admin,text/plain\n")
+	route := mustRoute(t, m, "/do")
+	if route.Method != "GET" {
+		t.Errorf("Method = %q, want GET (uppercased)", route.Method)
+	}
+	if route.Timeout != 5*time.Second {
+		t.Errorf("Timeout = %v, want 5s", route.Timeout)
+	}
+	if route.RateLimit != 42 {
+		t.Errorf("RateLimit = %d, want 42", route.RateLimit)
+	}
+	if route.Auth != "admin" {
+		t.Errorf("Auth = %q, want \"admin\"", route.Auth)
+	}
+	if route.ContentType != "text/plain" {
+		t.Errorf("ContentType = %q, want \"text/plain\"", route.ContentType)
+	}
+}
+
+func TestLoadRoutesIntoMapBadOptionalColumnsFallBackToDefaults(t *testing.T) {
+	m := loadRoutes(t, "/do,echo hi,get,not-a-duration,not-a-number\n")
+	route := mustRoute(t, m, "/do")
+	if route.Timeout != 0 {
+		t.Errorf("an unparseable timeout should be skipped, got %v", route.Timeout)
+	}
+	if route.RateLimit != -1 {
+		t.Errorf("an unparseable ratelimit should be skipped, got %d", route.RateLimit)
+	}
+}
+
+func TestLoadRoutesIntoMapSkipsBadRows(t *testing.T) {
+	m := loadRoutes(t, ",echo hi\n/do,\n/onlyonefield\n/metrics,echo pwn\n/-/reload,echo pwn\n/good,echo hi\n")
+	if _, ok := m.Load("/onlyonefield"); ok {
+		t.Error("a row missing the command column entirely must be skipped, not panic")
+	}
+	if _, ok := m.Load("/metrics"); ok {
+		t.Error("a route reusing the reserved /metrics path must be rejected")
+	}
+	if _, ok := m.Load("/-/reload"); ok {
+		t.Error("a route reusing the reserved /-/reload path must be rejected")
+	}
+	if _, ok := m.Load(""); ok {
+		t.Error("a row with no path must be skipped")
+	}
+	if _, ok := m.Load("/do"); ok {
+		t.Error("a row with no command must be skipped")
+	}
+	if _, ok := m.Load("/good"); !ok {
+		t.Error("a well-formed row among bad ones should still be loaded")
+	}
+}
+
+func TestRouteAuthorized(t *testing.T) {
+	open := &Route{Auth: ""}
+	if !RouteAuthorized(open, "", "") {
+		t.Error("a route with no Auth tag should be open to anyone")
+	}
+
+	restricted := &Route{Auth: "admin"}
+	if RouteAuthorized(restricted, "someone-else", "") {
+		t.Error("a mismatched client identity should not be authorized")
+	}
+	if !RouteAuthorized(restricted, "admin", "") {
+		t.Error("a matching mTLS identity should be authorized")
+	}
+	if !RouteAuthorized(restricted, "", "admin") {
+		t.Error("a matching bearer identity should be authorized")
+	}
+}
+
+func TestBearerIdentity(t *testing.T) {
+	tokens := map[string]string{"abc123": "admin"}
+
+	r := httptest.NewRequest(http.MethodGet, "/do", nil)
+	if got := BearerIdentity(r, tokens); got != "" {
+		t.Errorf("no Authorization header should yield \"\", got %q", got)
+	}
+
+	r.Header.Set("Authorization", "Bearer abc123")
+	if got := BearerIdentity(r, tokens); got != "admin" {
+		t.Errorf("got %q, want \"admin\"", got)
+	}
+
+	r.Header.Set("Authorization", "Bearer unknown-token")
+	if got := BearerIdentity(r, tokens); got != "" {
+		t.Errorf("an unrecognized token should yield \"\", got %q", got)
+	}
+}
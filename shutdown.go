@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CommandTracker tracks every bash process spuria currently has running, so
+// a graceful shutdown can wait for them to finish on their own, or - past a
+// deadline - force-kill whatever is left. Shared by ExecuteCommand and
+// StreamCommand, and survives routes.csv reloads the same way Metrics does.
+type CommandTracker struct {
+	wg      sync.WaitGroup
+	running sync.Map // pid (int) -> *exec.Cmd
+}
+
+// NewCommandTracker returns an empty CommandTracker.
+func NewCommandTracker() *CommandTracker {
+	return &CommandTracker{}
+}
+
+// Track registers cmd, whose Process must already be started, and returns a
+// func to call once it has exited. Callers must always call the returned
+// func, typically in a defer right after Track.
+func (t *CommandTracker) Track(cmd *exec.Cmd) (untrack func()) {
+	t.wg.Add(1)
+	pid := cmd.Process.Pid
+	t.running.Store(pid, cmd)
+	return func() {
+		t.running.Delete(pid)
+		t.wg.Done()
+	}
+}
+
+// Wait blocks until every tracked command has been untracked.
+func (t *CommandTracker) Wait() {
+	t.wg.Wait()
+}
+
+// KillAll sends SIGTERM to every still-tracked process, then SIGKILL to
+// whatever hasn't exited a moment later. Used once the shutdown deadline is
+// reached and in-flight commands are still running.
+func (t *CommandTracker) KillAll(logger *slog.Logger) {
+	t.running.Range(func(key, value any) bool {
+		pid := key.(int)
+		cmd := value.(*exec.Cmd)
+		logger.Warn("shutdown deadline reached, sending SIGTERM to in-flight command", "pid", pid)
+		cmd.Process.Signal(syscall.SIGTERM)
+		return true
+	})
+
+	time.Sleep(2 * time.Second)
+
+	t.running.Range(func(key, value any) bool {
+		pid := key.(int)
+		cmd := value.(*exec.Cmd)
+		logger.Warn("in-flight command still running, sending SIGKILL", "pid", pid)
+		cmd.Process.Kill()
+		return true
+	})
+}
+
+// WaitForShutdownSignal blocks until SIGINT or SIGTERM, then gracefully
+// drains the server: stop accepting new connections, wait up to
+// config.ShutdownTimeout for commands tracked by tracker to finish on their
+// own, and force-kill anything still running once that deadline passes.
+// Removes -pidfile on the way out, if set.
+func WaitForShutdownSignal(httpServer *http.Server, tracker *CommandTracker, config *Config, logger *slog.Logger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	logger.Info("shutdown signal received, draining in-flight commands", "signal", sig.String(), "timeout", config.ShutdownTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Warn("http server didn't shut down cleanly", "err", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tracker.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("all in-flight commands finished")
+	case <-ctx.Done():
+		logger.Warn("shutdown timeout reached with commands still running")
+		tracker.KillAll(logger)
+	}
+
+	if config.PidFile != "" {
+		if err := os.Remove(config.PidFile); err != nil {
+			logger.Warn("couldn't remove pidfile", "path", config.PidFile, "err", err)
+		}
+	}
+
+	logger.Info("shutdown complete")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// StreamCommandPrefix marks a CSV command column as a long-running job whose
+// output should be streamed to the client as it is produced, instead of being
+// buffered and returned once the process exits.
+const StreamCommandPrefix = "stream:"
+
+// streamPipeMaxLine is the longest single line streamPipe will buffer before
+// bufio.Scanner gives up with ErrTooLong - well above the default 64KB so a
+// chatty command doesn't silently lose output mid-line.
+const streamPipeMaxLine = 1024 * 1024
+
+// StreamCommand runs command and forwards its stdout/stderr to w line-by-line
+// as Server-Sent Events, until the process exits or the client disconnects.
+func StreamCommand(w http.ResponseWriter, r *http.Request, command string, config *Config, logger *slog.Logger, metrics *Metrics, tracker *CommandTracker, timeout time.Duration) {
+	path := r.URL.Path
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("streaming not supported by response writer", "path", path)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ec := exec.CommandContext(ctx, "bash", "-c", command)
+
+	stdoutPipe, err := ec.StdoutPipe()
+	if err != nil {
+		logger.Error("couldn't open stdout pipe", "path", path, "err", err)
+		return
+	}
+	stderrPipe, err := ec.StderrPipe()
+	if err != nil {
+		logger.Error("couldn't open stderr pipe", "path", path, "err", err)
+		return
+	}
+
+	if err := ec.Start(); err != nil {
+		logger.Error("couldn't start streaming command", "path", path, "err", err)
+		writeSSEFrame(w, flusher, "stderr", err.Error())
+		writeSSEFrame(w, flusher, "exit", "-1")
+		return
+	}
+
+	metrics.IncRunningCommands()
+	starttime := time.Now()
+	untrack := tracker.Track(ec)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var writeMu sync.Mutex
+	go streamPipe(&wg, &writeMu, w, flusher, "stdout", stdoutPipe, logger, path)
+	go streamPipe(&wg, &writeMu, w, flusher, "stderr", stderrPipe, logger, path)
+	wg.Wait()
+
+	exitCode := 0
+	if err := ec.Wait(); err != nil {
+		logger.Error("streaming execution error", "path", path, "err", err)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else {
+			exitCode = -1
+		}
+	}
+	untrack()
+
+	metrics.DecRunningCommands()
+	metrics.ObserveDuration(path, time.Since(starttime).Seconds())
+
+	writeMu.Lock()
+	writeSSEFrame(w, flusher, "exit", fmt.Sprint(exitCode))
+	writeMu.Unlock()
+
+	logger.Info("streaming execution finished", "path", path, "exitcode", exitCode)
+}
+
+func streamPipe(wg *sync.WaitGroup, writeMu *sync.Mutex, w http.ResponseWriter, flusher http.Flusher, event string, pipe interface{ Read([]byte) (int, error) }, logger *slog.Logger, path string) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(pipe)
+	scanner.Buffer(make([]byte, 0, 64*1024), streamPipeMaxLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+		logger.Debug("streaming line", "path", path, "event", event, "line", line)
+		writeMu.Lock()
+		writeSSEFrame(w, flusher, event, line)
+		writeMu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("streaming scan error, output may be truncated", "path", path, "event", event, "err", err)
+	}
+}
+
+func writeSSEFrame(w http.ResponseWriter, flusher http.Flusher, event string, data string) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	flusher.Flush()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidParam marks a substitution failure caused by bad caller input
+// (missing $ prefix, regex mismatch, repeated key, ...) as opposed to a
+// command execution failure, so handlers can return 400 instead of 500.
+var ErrInvalidParam = errors.New("invalid substitution parameter")
+
+var headerNameSanitizer = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// CollectParams gathers every value spuria is willing to substitute into a
+// command: GET query parameters, POST form fields, shallow JSON body fields
+// (dot-addressed when nested, e.g. $user.name), and the headers allow-listed
+// via -replaceheaders as $HEADER_NAME. Reading the body is harmless here even
+// when nothing ends up substituted, since ExecuteCommand only calls this
+// when -replaceparam is set.
+func CollectParams(r *http.Request, config *Config, logger *slog.Logger) url.Values {
+	params := url.Values{}
+	for name, values := range r.URL.Query() {
+		params[name] = append(params[name], values...)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logger.Warn("couldn't parse form body", "path", r.URL.Path, "err", err)
+	} else {
+		for name, values := range r.PostForm {
+			params[name] = append(params[name], values...)
+		}
+	}
+
+	if isJSONRequest(r) {
+		flat := map[string]string{}
+		if err := flattenJSONBody(r.Body, flat); err != nil && err != io.EOF {
+			logger.Warn("couldn't parse JSON body", "path", r.URL.Path, "err", err)
+		}
+		for name, value := range flat {
+			params[name] = append(params[name], value)
+		}
+	}
+
+	for name, value := range HeaderSubstitutions(r, config.ReplaceHeaders) {
+		params[name] = append(params[name], value)
+	}
+
+	return params
+}
+
+func isJSONRequest(r *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/json")
+}
+
+// flattenJSONBody decodes a JSON object body and flattens it into $-prefixed,
+// dot-addressed scalar fields, e.g. {"user":{"name":"bob"}} becomes
+// {"$user.name": "bob"}. Nested objects themselves are never substitutable -
+// only their scalar leaves are, and only by their full dotted path.
+func flattenJSONBody(body io.Reader, out map[string]string) error {
+	var data map[string]any
+	if err := json.NewDecoder(body).Decode(&data); err != nil {
+		return err
+	}
+	flattenJSONValue("", data, out)
+	return nil
+}
+
+func flattenJSONValue(prefix string, value any, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			flattenJSONValue(prefix+key+".", child, out)
+		}
+	case []any:
+		// arrays aren't addressable as a single scalar, skip them
+	case nil:
+		// omit nulls rather than substituting the literal "<nil>"
+	default:
+		out["$"+strings.TrimSuffix(prefix, ".")] = fmt.Sprint(v)
+	}
+}
+
+// HeaderSubstitutions returns the $HEADER_NAME substitutions for the headers
+// named in allowedHeaders that are actually present on the request.
+func HeaderSubstitutions(r *http.Request, allowedHeaders []string) map[string]string {
+	out := map[string]string{}
+	for _, header := range allowedHeaders {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		value := r.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		name := "$HEADER_" + strings.ToUpper(headerNameSanitizer.ReplaceAllString(header, "_"))
+		out[name] = value
+	}
+	return out
+}
+
+// ApplySubstitutions replaces every validated $name placeholder in command
+// with its value from params, using the same ReplaceRegex/DontStopReplacing
+// rules -replaceparam has always used for GET parameters.
+func ApplySubstitutions(command string, params url.Values, config *Config, logger *slog.Logger, path string) (string, error) {
+	logger.Info("replacing params", "path", path, "params", params)
+	for name, values := range params {
+		value := values[0]
+		if len(values) != 1 {
+			logger.Warn("param error, please only set a parameter's value once for each key", "path", path, "name", name, "length", len(values))
+			if config.DontStopReplacing {
+				continue
+			}
+			return command, fmt.Errorf("%w: param has more than 1 or less than 1 values", ErrInvalidParam)
+		}
+
+		if !strings.HasPrefix(name, "$") {
+			logger.Warn("param error, name has to begin with $", "path", path, "name", name, "value", value)
+			if config.DontStopReplacing {
+				continue
+			}
+			return command, fmt.Errorf("%w: param name doesn't begin with $", ErrInvalidParam)
+		}
+		if !config.ReplaceRegex.MatchString(value) {
+			logger.Warn("param error, invalid input for regex", "path", path, "name", name, "value", value)
+			if config.DontStopReplacing {
+				continue
+			}
+			return command, fmt.Errorf("%w: param value doesn't match regex", ErrInvalidParam)
+		}
+		logger.Debug("substituting param", "path", path, "name", name, "value", value)
+		command = strings.ReplaceAll(command, name, value)
+	}
+	return command, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFlattenJSONBody(t *testing.T) {
+	body := `{"user":{"name":"bob","age":30},"tags":["a","b"],"note":null,"active":true}`
+	out := map[string]string{}
+	if err := flattenJSONBody(strings.NewReader(body), out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		"$user.name": "bob",
+		"$user.age":  "30",
+		"$active":    "true",
+	}
+	for k, v := range want {
+		if out[k] != v {
+			t.Errorf("out[%q] = %q, want %q", k, out[k], v)
+		}
+	}
+	if _, ok := out["$tags"]; ok {
+		t.Error("arrays should not be flattened into a substitutable param")
+	}
+	if _, ok := out["$note"]; ok {
+		t.Error("null fields should be omitted, not substituted as \"<nil>\"")
+	}
+}
+
+func TestHeaderSubstitutions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/do", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("X-Unused", "nope")
+
+	out := HeaderSubstitutions(r, []string{"X-Api-Key", " X-Missing "})
+	if out["$HEADER_X_API_KEY"] != "secret" {
+		t.Errorf("got %q, want \"secret\"", out["$HEADER_X_API_KEY"])
+	}
+	if _, ok := out["$HEADER_X_UNUSED"]; ok {
+		t.Error("a header not in allowedHeaders must not be substituted")
+	}
+	if _, ok := out["$HEADER_X_MISSING"]; ok {
+		t.Error("an allow-listed header absent from the request must not appear")
+	}
+}
+
+func singleParam(name, value string) url.Values {
+	return url.Values{name: []string{value}}
+}
+
+func TestApplySubstitutions(t *testing.T) {
+	config := &Config{ReplaceRegex: regexp.MustCompile(`^[a-zA-Z0-9]*$`)}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	out, err := ApplySubstitutions("echo $name", singleParam("$name", "bob"), config, logger, "/do")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "echo bob" {
+		t.Errorf("got %q, want \"echo bob\"", out)
+	}
+
+	_, err = ApplySubstitutions("echo $name", singleParam("name", "bob"), config, logger, "/do")
+	if err == nil {
+		t.Error("a param name missing the $ prefix should be rejected")
+	}
+
+	_, err = ApplySubstitutions("echo $name", singleParam("$name", "bob; rm -rf /"), config, logger, "/do")
+	if err == nil {
+		t.Error("a value failing ReplaceRegex should be rejected")
+	}
+
+	config.DontStopReplacing = true
+	out, err = ApplySubstitutions("echo $name", singleParam("$name", "bob; rm -rf /"), config, logger, "/do")
+	if err != nil {
+		t.Fatalf("-nostop should swallow the error, got: %v", err)
+	}
+	if out != "echo $name" {
+		t.Errorf("got %q, want the placeholder left untouched", out)
+	}
+}
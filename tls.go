@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// buildTLSConfig assembles the *tls.Config used by ListenAndServeTLS.
+// When config.ClientCAPath is set it enables mTLS and requires a client
+// certificate signed by one of the CAs in that bundle.
+func buildTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.ClientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	caBytes, err := os.ReadFile(config.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read clientca file: %w", err)
+	}
+
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("couldn't parse any certificates from clientca file %q", config.ClientCAPath)
+	}
+
+	tlsConfig.ClientCAs = caPool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return tlsConfig, nil
+}
+
+// ClientIdentity returns the CommonName of the client certificate presented
+// for this request, or "" if the request wasn't made over mTLS.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// IsAuthorized decides whether a request is allowed in, based on the source
+// IP whitelist and/or the mTLS client identity whitelist. If both are
+// configured, matching either one is enough - this lets -clientca be used
+// instead of or in addition to -allowedips.
+func IsAuthorized(config *Config, ip string, identity string) bool {
+	if !config.IPwhitelist && !config.IdentityWhitelist {
+		return true
+	}
+
+	if config.IPwhitelist && config.WhitelistedIPs[ip] {
+		return true
+	}
+
+	if config.IdentityWhitelist && identity != "" && config.WhitelistedIdentities[identity] {
+		return true
+	}
+
+	return false
+}